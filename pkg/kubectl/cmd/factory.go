@@ -0,0 +1,46 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"io"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api/meta"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl/resource"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/runtime"
+
+	"github.com/spf13/cobra"
+)
+
+// Factory provides abstractions that allow kubectl commands to be extended
+// across multiple types of resources and client configurations without
+// depending on any one of them directly. Each field is a function so that
+// commands can be tested against fakes without standing up a real cluster.
+type Factory struct {
+	// Object returns a client-side object mapper/typer pair for working with API objects.
+	Object func() (meta.RESTMapper, runtime.ObjectTyper)
+	// RESTClient returns a RESTClient for the currently configured context, or an error.
+	RESTClient func() (resource.RESTClient, error)
+	// DefaultNamespace returns the namespace to act against when none is given on the command line.
+	DefaultNamespace func() (string, error)
+	// PrintObject prints obj to out using the format requested by cmd.
+	PrintObject func(cmd *cobra.Command, obj runtime.Object, out io.Writer) error
+	// ClientsForContexts resolves each named kubeconfig context to a RESTClient
+	// talking to that cluster. An empty contexts list resolves every context
+	// in the kubeconfig, for commands that support --all-contexts.
+	ClientsForContexts func(contexts []string) ([]resource.RESTClient, error)
+}
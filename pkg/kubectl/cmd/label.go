@@ -0,0 +1,548 @@
+/*
+Copyright 2014 Google Inc. All rights reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
+	apierrors "github.com/GoogleCloudPlatform/kubernetes/pkg/api/errors"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/api/meta"
+	cmdutil "github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl/cmd/util"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/kubectl/resource"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/runtime"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/util/diff"
+	utilerrors "github.com/GoogleCloudPlatform/kubernetes/pkg/util/errors"
+
+	"github.com/spf13/cobra"
+)
+
+// errLabelPreconditionUnmet is returned by labelFunc when an --if-label
+// precondition doesn't match the object's current labels. RunLabel treats
+// this as a skip rather than a fatal error.
+var errLabelPreconditionUnmet = errors.New("label precondition not satisfied")
+
+const (
+	label_long = `Update the labels on a resource.
+
+A label must begin with a letter or number, and may contain letters, numbers, hyphens,
+dots, and underscores, up to 63 characters. If --overwrite is true, then existing labels
+can be overwritten, otherwise attempting to overwrite a label will result in an error. If
+--resource-version is specified, then updates will use this resource version, otherwise
+the existing resource-version will be used.`
+	label_example = `// Update pod 'foo' with the label 'unhealthy' and the value 'true'.
+$ kubectl label pods foo unhealthy=true
+
+// Update pod 'foo' with the label 'status' and the value 'unhealthy', overwriting any existing value.
+$ kubectl label --overwrite pods foo status=unhealthy
+
+// Update all pods in the namespace.
+$ kubectl label pods --all status=unhealthy
+
+// Update only the pods matching a label selector, leaving the rest of the namespace untouched.
+$ kubectl label pods --selector=tier=frontend status=unhealthy
+
+// Update pod 'foo' only if the resource is unchanged from version 1.
+$ kubectl label pods foo status=unhealthy --resource-version=1
+
+// Update pod 'foo' by removing a label named 'bar' if it exists.
+// Does not require the --overwrite flag.
+$ kubectl label pods foo bar-
+
+// Update only the pods that are currently in the frontend tier and not in prod,
+// leaving every other pod in the --all set untouched.
+$ kubectl label pods --all --if-label=tier=frontend,env!=prod restarted=true
+
+// Apply the same label change across every cluster in the kubeconfig.
+$ kubectl label pods --all-contexts --all region=us-west`
+)
+
+func NewCmdLabel(f *Factory, out io.Writer) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "label [--overwrite] RESOURCE NAME KEY_1=VAL_1 ... KEY_N=VAL_N [--resource-version=version]",
+		Short:   "Update the labels on a resource",
+		Long:    label_long,
+		Example: label_example,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := RunLabel(f, out, cmd, args)
+			cmdutil.CheckErr(err)
+		},
+	}
+	cmd.Flags().Bool("overwrite", false, "If true, allow labels to be overwritten, otherwise reject label updates that overwrite existing labels.")
+	cmd.Flags().Bool("all", false, "Select all resources in the namespace of the specified resource types")
+	cmd.Flags().StringP("selector", "l", "", "Selector (label query) to filter on, only applying the label change to objects that match it")
+	cmd.Flags().String("field-selector", "", "Selector (field query) to filter on, only applying the label change to objects that match it")
+	cmd.Flags().StringSlice("if-label", []string{}, "Label selector(s) that an object's current labels must satisfy for the mutation to apply; may be repeated, all must match. Objects that don't match are skipped rather than erroring.")
+	cmd.Flags().String("resource-version", "", "If non-empty, the labels update will only succeed if this is the current resource-version for the object.")
+	cmd.Flags().Int("retries", 5, "Number of times to retry a label update that lost a resourceVersion race with another writer, with exponential backoff")
+	cmd.Flags().String("patch-type", "strategic", "The type of patch to send to the server to apply the label change: json, merge, or strategic")
+	cmd.Flags().Bool("dry-run", false, "If true, only print the object as it would look once labelled, without sending anything to the server")
+	cmd.Flags().StringP("output", "o", "", "Output format. One of: diff (show a unified diff of the object's metadata before/after)")
+	cmd.Flags().StringSlice("contexts", []string{}, "Comma-separated kubeconfig context names to apply the label change to, fanning the same mutation out across multiple clusters")
+	cmd.Flags().Bool("all-contexts", false, "Apply the label change to every context in the kubeconfig, instead of just the current one")
+	return cmd
+}
+
+// parseLabels turns a list of strings in the form key=value, or key- (for a
+// removal), into a map of labels to add and a list of labels to remove.
+func parseLabels(spec []string) (map[string]string, []string, error) {
+	labels := map[string]string{}
+	var remove []string
+	for _, labelSpec := range spec {
+		if strings.Contains(labelSpec, "=") {
+			parts := strings.Split(labelSpec, "=")
+			if len(parts) != 2 || len(parts[1]) == 0 {
+				return nil, nil, fmt.Errorf("invalid label spec: %v", labelSpec)
+			}
+			labels[parts[0]] = parts[1]
+		} else if strings.HasSuffix(labelSpec, "-") {
+			remove = append(remove, labelSpec[:len(labelSpec)-1])
+		} else {
+			return nil, nil, fmt.Errorf("unknown label spec: %v", labelSpec)
+		}
+	}
+	for _, removeLabel := range remove {
+		if _, found := labels[removeLabel]; found {
+			return nil, nil, fmt.Errorf("can not both modify and remove a label in the same command")
+		}
+	}
+	return labels, remove, nil
+}
+
+// validateNoOverwrites validates that the incoming labels don't touch any
+// label the object already has, whatever its current value.
+func validateNoOverwrites(meta *api.ObjectMeta, labels map[string]string) error {
+	for key := range labels {
+		if currentValue, found := meta.Labels[key]; found {
+			return fmt.Errorf("'%s' already has a value (%s), and --overwrite is false", key, currentValue)
+		}
+	}
+	return nil
+}
+
+// computeDesiredLabels applies the requested adds/removes to meta's current
+// labels and returns the resulting label set, without mutating meta. It is
+// kept separate from labelFunc's apply step so a conflict retry can replay
+// the same add/remove request against a freshly-fetched object.
+func computeDesiredLabels(meta *api.ObjectMeta, overwrite bool, newLabels map[string]string, remove []string, precondition labels.Selector) (map[string]string, error) {
+	if precondition != nil && !precondition.Matches(labels.Set(meta.Labels)) {
+		return nil, errLabelPreconditionUnmet
+	}
+	if !overwrite {
+		if err := validateNoOverwrites(meta, newLabels); err != nil {
+			return nil, err
+		}
+	}
+
+	desired := map[string]string{}
+	for key, value := range meta.Labels {
+		desired[key] = value
+	}
+	for key, value := range newLabels {
+		desired[key] = value
+	}
+	for _, label := range remove {
+		delete(desired, label)
+	}
+	return desired, nil
+}
+
+func labelFunc(obj runtime.Object, overwrite bool, resourceVersion string, newLabels map[string]string, remove []string, precondition labels.Selector) (runtime.Object, error) {
+	meta, err := api.ObjectMetaFor(obj)
+	if err != nil {
+		return nil, err
+	}
+	desired, err := computeDesiredLabels(meta, overwrite, newLabels, remove, precondition)
+	if err != nil {
+		return nil, err
+	}
+	meta.Labels = desired
+
+	if len(resourceVersion) != 0 {
+		meta.ResourceVersion = resourceVersion
+	}
+	return obj, nil
+}
+
+// parsePatchType maps the --patch-type flag value onto the wire PatchType
+// the apiserver expects.
+func parsePatchType(patchType string) (api.PatchType, error) {
+	switch patchType {
+	case "json":
+		return api.JSONPatchType, nil
+	case "merge":
+		return api.MergePatchType, nil
+	case "strategic":
+		return api.StrategicMergePatchType, nil
+	default:
+		return "", fmt.Errorf("invalid patch-type %q, must be one of json, merge, strategic", patchType)
+	}
+}
+
+// jsonPatchOp is a single RFC 6902 JSON Patch operation. Value holds either
+// a single label's string value or, when replacing the whole labels map in
+// one op, a map[string]string.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// escapeJSONPointerToken escapes a map key for use as a JSON Pointer path
+// segment, per RFC 6901.
+func escapeJSONPointerToken(token string) string {
+	token = strings.Replace(token, "~", "~0", -1)
+	token = strings.Replace(token, "/", "~1", -1)
+	return token
+}
+
+// buildLabelPatch builds the smallest patch body, in the requested
+// patchType, that takes an object's labels from original to desired. Only
+// keys that actually change are included, and for json patches a test of
+// resourceVersion is prepended so the patch fails atomically if another
+// writer raced us, rather than silently applying over stale data.
+func buildLabelPatch(original, desired map[string]string, resourceVersion string, patchType api.PatchType) ([]byte, error) {
+	switch patchType {
+	case api.JSONPatchType:
+		ops := []jsonPatchOp{}
+		if len(resourceVersion) != 0 {
+			ops = append(ops, jsonPatchOp{Op: "test", Path: "/metadata/resourceVersion", Value: resourceVersion})
+		}
+		if len(original) == 0 {
+			// ObjectMeta.Labels is omitempty, so an unlabelled object has no
+			// /metadata/labels container at all; RFC 6902 forbids "add" into
+			// a path whose parent doesn't exist, so replace the whole map
+			// in one op instead of adding each key under it.
+			if len(desired) != 0 {
+				ops = append(ops, jsonPatchOp{Op: "add", Path: "/metadata/labels", Value: desired})
+			}
+			return json.Marshal(ops)
+		}
+		for key, value := range desired {
+			if current, ok := original[key]; !ok || current != value {
+				ops = append(ops, jsonPatchOp{Op: "add", Path: "/metadata/labels/" + escapeJSONPointerToken(key), Value: value})
+			}
+		}
+		for key := range original {
+			if _, ok := desired[key]; !ok {
+				ops = append(ops, jsonPatchOp{Op: "remove", Path: "/metadata/labels/" + escapeJSONPointerToken(key)})
+			}
+		}
+		return json.Marshal(ops)
+
+	case api.MergePatchType, api.StrategicMergePatchType:
+		labelsPatch := map[string]interface{}{}
+		for key, value := range desired {
+			if current, ok := original[key]; !ok || current != value {
+				labelsPatch[key] = value
+			}
+		}
+		for key := range original {
+			if _, ok := desired[key]; !ok {
+				labelsPatch[key] = nil
+			}
+		}
+		metadata := map[string]interface{}{"labels": labelsPatch}
+		if len(resourceVersion) != 0 {
+			metadata["resourceVersion"] = resourceVersion
+		}
+		return json.Marshal(map[string]interface{}{"metadata": metadata})
+
+	default:
+		return nil, fmt.Errorf("unsupported patch type: %v", patchType)
+	}
+}
+
+// retryOnConflict calls fn until it succeeds, fn returns a non-conflict
+// error, or fn has been retried maxRetries times (maxRetries+1 calls in all),
+// backing off exponentially between attempts starting at 100ms.
+func retryOnConflict(maxRetries int, fn func() error) error {
+	backoff := 100 * time.Millisecond
+	var err error
+	for i := 0; ; i++ {
+		err = fn()
+		if err == nil || !apierrors.IsConflict(err) || i >= maxRetries {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// labelDryRun computes the object labelFunc would produce without writing
+// it back to the server. When outputFormat is "diff" it also prints a
+// unified diff of the object's ObjectMeta before and after the mutation.
+func labelDryRun(f *Factory, out io.Writer, cmd *cobra.Command, info *resource.Info, overwrite bool, resourceVersion string, newLabels map[string]string, remove []string, precondition labels.Selector, outputFormat string) error {
+	original, err := api.Scheme.Copy(info.Object)
+	if err != nil {
+		return err
+	}
+	mutated, err := labelFunc(info.Object, overwrite, resourceVersion, newLabels, remove, precondition)
+	if err == errLabelPreconditionUnmet {
+		return f.PrintObject(cmd, info.Object, out)
+	}
+	if err != nil {
+		return err
+	}
+	if outputFormat == "diff" {
+		originalMeta, err := api.ObjectMetaFor(original)
+		if err != nil {
+			return err
+		}
+		mutatedMeta, err := api.ObjectMetaFor(mutated)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(out, diff.ObjectDiff(*originalMeta, *mutatedMeta))
+	}
+	return f.PrintObject(cmd, mutated, out)
+}
+
+func RunLabel(f *Factory, out io.Writer, cmd *cobra.Command, args []string) error {
+	resourceVersion := cmdutil.GetFlagString(cmd, "resource-version")
+	all := cmdutil.GetFlagBool(cmd, "all")
+	overwrite := cmdutil.GetFlagBool(cmd, "overwrite")
+	selector := cmdutil.GetFlagString(cmd, "selector")
+	fieldSelector := cmdutil.GetFlagString(cmd, "field-selector")
+	ifLabel, err := cmd.Flags().GetStringSlice("if-label")
+	if err != nil {
+		return err
+	}
+	retries := cmdutil.GetFlagInt(cmd, "retries")
+	patchType, err := parsePatchType(cmdutil.GetFlagString(cmd, "patch-type"))
+	if err != nil {
+		return cmdutil.UsageError(cmd, err.Error())
+	}
+	dryRun := cmdutil.GetFlagBool(cmd, "dry-run")
+	outputFormat := cmdutil.GetFlagString(cmd, "output")
+
+	resources, labelArgs := []string{}, []string{}
+	first := true
+	for _, s := range args {
+		isLabel := strings.Contains(s, "=") || strings.HasSuffix(s, "-")
+		switch {
+		case first && isLabel:
+			first = false
+			fallthrough
+		case !first && isLabel:
+			labelArgs = append(labelArgs, s)
+		default:
+			resources = append(resources, s)
+		}
+	}
+	if len(resources) < 1 {
+		return cmdutil.UsageError(cmd, "one or more resources must be specified as <resource> <name>")
+	}
+	if len(labelArgs) < 1 {
+		return cmdutil.UsageError(cmd, "at least one label update is required")
+	}
+
+	labelsToApply, remove, err := parseLabels(labelArgs)
+	if err != nil {
+		return cmdutil.UsageError(cmd, err.Error())
+	}
+
+	var precondition labels.Selector
+	if len(ifLabel) > 0 {
+		precondition, err = labels.Parse(strings.Join(ifLabel, ","))
+		if err != nil {
+			return cmdutil.UsageError(cmd, err.Error())
+		}
+	}
+
+	cmdNamespace, err := f.DefaultNamespace()
+	if err != nil {
+		return err
+	}
+
+	contexts, err := cmd.Flags().GetStringSlice("contexts")
+	if err != nil {
+		return err
+	}
+	allContexts := cmdutil.GetFlagBool(cmd, "all-contexts")
+
+	mapper, typer := f.Object()
+
+	opts := labelOptions{
+		cmdNamespace:    cmdNamespace,
+		all:             all,
+		overwrite:       overwrite,
+		resources:       resources,
+		selector:        selector,
+		fieldSelector:   fieldSelector,
+		labelsToApply:   labelsToApply,
+		remove:          remove,
+		precondition:    precondition,
+		resourceVersion: resourceVersion,
+		retries:         retries,
+		patchType:       patchType,
+		dryRun:          dryRun,
+		outputFormat:    outputFormat,
+	}
+
+	if !allContexts && len(contexts) == 0 {
+		client, err := f.RESTClient()
+		if err != nil {
+			return err
+		}
+		return labelWithClient(f, out, cmd, mapper, typer, client, opts)
+	}
+
+	// ClientsForContexts resolves each named context to a RESTClient talking
+	// to that cluster; a nil/empty list means "every context in the
+	// kubeconfig" (the --all-contexts case).
+	requested := contexts
+	if allContexts {
+		requested = nil
+	}
+	clients, err := f.ClientsForContexts(requested)
+	if err != nil {
+		return err
+	}
+
+	const maxConcurrentContexts = 4
+	sem := make(chan struct{}, maxConcurrentContexts)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var errs []error
+
+	// Each goroutine prints to its own buffer rather than the shared out,
+	// since out (typically a *bytes.Buffer) isn't safe for concurrent
+	// writes; buffers are flushed in client order once everyone is done.
+	buffers := make([]bytes.Buffer, len(clients))
+
+	for i, c := range clients {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, client resource.RESTClient) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := labelWithClient(f, &buffers[i], cmd, mapper, typer, client, opts); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for i := range buffers {
+		out.Write(buffers[i].Bytes())
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// labelOptions carries the parsed --flags for a single label invocation so
+// they can be replayed unchanged against every cluster in a --contexts fan-out.
+type labelOptions struct {
+	cmdNamespace    string
+	all             bool
+	overwrite       bool
+	resources       []string
+	selector        string
+	fieldSelector   string
+	labelsToApply   map[string]string
+	remove          []string
+	precondition    labels.Selector
+	resourceVersion string
+	retries         int
+	patchType       api.PatchType
+	dryRun          bool
+	outputFormat    string
+}
+
+// labelWithClient runs one full label operation — list, mutate, write —
+// against a single cluster's RESTClient. It is the unit of work fanned out
+// across --contexts.
+func labelWithClient(f *Factory, out io.Writer, cmd *cobra.Command, mapper meta.RESTMapper, typer runtime.ObjectTyper, client resource.RESTClient, opts labelOptions) error {
+	r := resource.NewBuilder(mapper, typer, resource.ClientMapperFunc(func(*meta.RESTMapping) (resource.RESTClient, error) {
+		return client, nil
+	})).
+		ContinueOnError().
+		NamespaceParam(opts.cmdNamespace).DefaultNamespace().
+		SelectorParam(opts.selector).
+		FieldSelectorParam(opts.fieldSelector).
+		ResourceTypeOrNameArgs(opts.all, opts.resources...).
+		Flatten().
+		Do()
+	if err := r.Err(); err != nil {
+		return err
+	}
+
+	return r.Visit(func(info *resource.Info) error {
+		if opts.dryRun {
+			return labelDryRun(f, out, cmd, info, opts.overwrite, opts.resourceVersion, opts.labelsToApply, opts.remove, opts.precondition, opts.outputFormat)
+		}
+		helper := resource.NewHelper(client, info.Mapping)
+		var printObj runtime.Object
+		err := retryOnConflict(opts.retries, func() error {
+			meta, err := api.ObjectMetaFor(info.Object)
+			if err != nil {
+				return err
+			}
+			original := map[string]string{}
+			for key, value := range meta.Labels {
+				original[key] = value
+			}
+			desired, err := computeDesiredLabels(meta, opts.overwrite, opts.labelsToApply, opts.remove, opts.precondition)
+			if err == errLabelPreconditionUnmet {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			resourceVersion := opts.resourceVersion
+			if len(resourceVersion) == 0 {
+				resourceVersion = meta.ResourceVersion
+			}
+			patch, err := buildLabelPatch(original, desired, resourceVersion, opts.patchType)
+			if err != nil {
+				return err
+			}
+			_, err = helper.Patch(info.Namespace, info.Name, opts.patchType, patch)
+			if err != nil {
+				if apierrors.IsConflict(err) {
+					fresh, getErr := helper.Get(info.Namespace, info.Name)
+					if getErr != nil {
+						return getErr
+					}
+					info.Object = fresh
+				}
+				return err
+			}
+			meta.Labels = desired
+			printObj = info.Object
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if printObj == nil {
+			return f.PrintObject(cmd, info.Object, out)
+		}
+		return f.PrintObject(cmd, printObj, out)
+	})
+}
@@ -18,6 +18,8 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"reflect"
 	"strings"
@@ -25,6 +27,7 @@ import (
 
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/api"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/client"
+	"github.com/GoogleCloudPlatform/kubernetes/pkg/labels"
 	"github.com/GoogleCloudPlatform/kubernetes/pkg/runtime"
 )
 
@@ -144,13 +147,15 @@ func TestParseLabels(t *testing.T) {
 
 func TestLabelFunc(t *testing.T) {
 	tests := []struct {
-		obj       runtime.Object
-		overwrite bool
-		version   string
-		labels    map[string]string
-		remove    []string
-		expected  runtime.Object
-		expectErr bool
+		obj          runtime.Object
+		overwrite    bool
+		version      string
+		labels       map[string]string
+		remove       []string
+		precondition labels.Selector
+		expected     runtime.Object
+		expectErr    bool
+		expectSkip   bool
 	}{
 		{
 			obj: &api.Pod{
@@ -245,9 +250,39 @@ func TestLabelFunc(t *testing.T) {
 				},
 			},
 		},
+		{
+			obj: &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Labels: map[string]string{"tier": "frontend"},
+				},
+			},
+			labels:       map[string]string{"restarted": "true"},
+			precondition: labels.SelectorFromSet(labels.Set{"tier": "frontend"}),
+			expected: &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Labels: map[string]string{"tier": "frontend", "restarted": "true"},
+				},
+			},
+		},
+		{
+			obj: &api.Pod{
+				ObjectMeta: api.ObjectMeta{
+					Labels: map[string]string{"tier": "backend"},
+				},
+			},
+			labels:       map[string]string{"restarted": "true"},
+			precondition: labels.SelectorFromSet(labels.Set{"tier": "frontend"}),
+			expectSkip:   true,
+		},
 	}
 	for _, test := range tests {
-		out, err := labelFunc(test.obj, test.overwrite, test.version, test.labels, test.remove)
+		out, err := labelFunc(test.obj, test.overwrite, test.version, test.labels, test.remove, test.precondition)
+		if test.expectSkip {
+			if err != errLabelPreconditionUnmet {
+				t.Errorf("expected a skipped precondition, got: %v", err)
+			}
+			continue
+		}
 		if test.expectErr {
 			if err == nil {
 				t.Errorf("unexpected non-error: %v", test)
@@ -316,6 +351,7 @@ func TestLabelErrors(t *testing.T) {
 
 func TestLabelMultipleObjects(t *testing.T) {
 	pods, _, _ := testData()
+	var sawPatch int
 
 	f, tf, codec := NewAPIFactory()
 	tf.Printer = &testPrinter{}
@@ -331,16 +367,23 @@ func TestLabelMultipleObjects(t *testing.T) {
 					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
 					return nil, nil
 				}
-			case "PUT":
+			case "PATCH":
 				switch req.URL.Path {
 				case "/namespaces/test/pods/foo":
+					sawPatch++
+					assertLabelPatchAdds(t, req, "a", "b")
 					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[0])}, nil
 				case "/namespaces/test/pods/bar":
+					sawPatch++
+					assertLabelPatchAdds(t, req, "a", "b")
 					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[1])}, nil
 				default:
 					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
 					return nil, nil
 				}
+			case "PUT":
+				t.Fatalf("label should PATCH, not PUT: %#v", req.URL)
+				return nil, nil
 			default:
 				t.Fatalf("unexpected request: %s %#v\n%#v", req.Method, req.URL, req)
 				return nil, nil
@@ -358,10 +401,319 @@ func TestLabelMultipleObjects(t *testing.T) {
 		t.Fatalf("unexpected error: %v", err)
 	}
 
+	if sawPatch != 2 {
+		t.Errorf("expected 2 PATCH requests, got %d", sawPatch)
+	}
 	if tf.Printer.(*testPrinter).Objects == nil {
 		t.Errorf("unexpected non print to default printer")
 	}
 	if !reflect.DeepEqual(tf.Printer.(*testPrinter).Objects[0].(*api.Pod).Labels, map[string]string{"a": "b"}) {
 		t.Errorf("did not set labels: %#v", string(buf.Bytes()))
 	}
+
+	// A second invocation scoped by --selector should only PATCH the pods
+	// matching it, rather than every pod in --all.
+	selectorPods := &api.PodList{
+		Items: []api.Pod{
+			{ObjectMeta: api.ObjectMeta{Name: "foo", Labels: map[string]string{"tier": "frontend"}}},
+		},
+	}
+	f2, tf2, codec2 := NewAPIFactory()
+	tf2.Printer = &testPrinter{}
+	tf2.Client = &client.FakeRESTClient{
+		Codec: codec2,
+		Client: client.HTTPClientFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "GET":
+				switch req.URL.Path {
+				case "/namespaces/test/pods":
+					if req.URL.Query().Get("labelSelector") != "tier=frontend" {
+						t.Fatalf("unexpected selector: %s", req.URL.RawQuery)
+					}
+					return &http.Response{StatusCode: 200, Body: objBody(codec2, selectorPods)}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			case "PATCH":
+				switch req.URL.Path {
+				case "/namespaces/test/pods/foo":
+					return &http.Response{StatusCode: 200, Body: objBody(codec2, &selectorPods.Items[0])}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			default:
+				t.Fatalf("unexpected request: %s %#v\n%#v", req.Method, req.URL, req)
+				return nil, nil
+			}
+		}),
+	}
+	tf2.Namespace = "test"
+	tf2.ClientConfig = &client.Config{Version: "v1beta1"}
+	buf2 := bytes.NewBuffer([]byte{})
+
+	cmd2 := NewCmdLabel(f2, buf2)
+	cmd2.Flags().Set("all", "true")
+	cmd2.Flags().Set("selector", "tier=frontend")
+	if err := RunLabel(f2, buf2, cmd2, []string{"pods", "restarted=true"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(tf2.Printer.(*testPrinter).Objects[0].(*api.Pod).Labels, map[string]string{"tier": "frontend", "restarted": "true"}) {
+		t.Errorf("did not set labels: %#v", string(buf2.Bytes()))
+	}
+}
+
+// assertLabelPatchAdds decodes a strategic-merge-patch body produced by
+// kubectl label and fails the test if it doesn't add key=value.
+func assertLabelPatchAdds(t *testing.T, req *http.Request, key, value string) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		t.Fatalf("unable to read patch body: %v", err)
+	}
+	var patch struct {
+		Metadata struct {
+			Labels map[string]string `json:"labels"`
+		} `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &patch); err != nil {
+		t.Fatalf("unable to decode patch body %s: %v", string(body), err)
+	}
+	if patch.Metadata.Labels[key] != value {
+		t.Errorf("expected patch to add %s=%s, got: %s", key, value, string(body))
+	}
+}
+
+func TestLabelConflictRetry(t *testing.T) {
+	pods, _, _ := testData()
+	attempts := 0
+
+	f, tf, codec := NewAPIFactory()
+	tf.Printer = &testPrinter{}
+	tf.Client = &client.FakeRESTClient{
+		Codec: codec,
+		Client: client.HTTPClientFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "GET":
+				switch req.URL.Path {
+				case "/namespaces/test/pods/foo":
+					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[0])}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			case "PATCH":
+				switch req.URL.Path {
+				case "/namespaces/test/pods/foo":
+					attempts++
+					if attempts == 1 {
+						return &http.Response{StatusCode: 409, Body: objBody(codec, &api.Status{
+							Status: api.StatusFailure,
+							Reason: api.StatusReasonConflict,
+						})}, nil
+					}
+					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[0])}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			default:
+				t.Fatalf("unexpected request: %s %#v\n%#v", req.Method, req.URL, req)
+				return nil, nil
+			}
+		}),
+	}
+	tf.Namespace = "test"
+	tf.ClientConfig = &client.Config{Version: "v1beta1"}
+	buf := bytes.NewBuffer([]byte{})
+
+	cmd := NewCmdLabel(f, buf)
+	cmd.Flags().Set("retries", "1")
+	if err := RunLabel(f, buf, cmd, []string{"pods", "foo", "a=b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected a re-PATCH after the conflict, got %d attempts", attempts)
+	}
+}
+
+func TestBuildLabelPatchJSONUnlabelled(t *testing.T) {
+	// An object with no existing labels has no /metadata/labels container at
+	// all (Labels is omitempty), so RFC 6902 forbids "add"ing into it a key
+	// at a time; the whole map must be added in one op instead.
+	body, err := buildLabelPatch(map[string]string{}, map[string]string{"a": "b"}, "", api.JSONPatchType)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		t.Fatalf("expected a JSON patch array, got %s: %v", string(body), err)
+	}
+	if len(ops) != 1 {
+		t.Fatalf("expected a single op, got %s", string(body))
+	}
+	if ops[0]["op"] != "add" || ops[0]["path"] != "/metadata/labels" {
+		t.Errorf("expected an add of the whole labels map, got %s", string(body))
+	}
+	value, ok := ops[0]["value"].(map[string]interface{})
+	if !ok || value["a"] != "b" {
+		t.Errorf("expected value to be the full desired label set, got %s", string(body))
+	}
+}
+
+func TestLabelJSONPatchType(t *testing.T) {
+	pods, _, _ := testData()
+	var body []byte
+
+	f, tf, codec := NewAPIFactory()
+	tf.Printer = &testPrinter{}
+	tf.Client = &client.FakeRESTClient{
+		Codec: codec,
+		Client: client.HTTPClientFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "GET":
+				switch req.URL.Path {
+				case "/namespaces/test/pods/foo":
+					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[0])}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			case "PATCH":
+				switch req.URL.Path {
+				case "/namespaces/test/pods/foo":
+					var err error
+					body, err = ioutil.ReadAll(req.Body)
+					if err != nil {
+						t.Fatalf("unable to read patch body: %v", err)
+					}
+					return &http.Response{StatusCode: 200, Body: objBody(codec, &pods.Items[0])}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			default:
+				t.Fatalf("unexpected request: %s %#v\n%#v", req.Method, req.URL, req)
+				return nil, nil
+			}
+		}),
+	}
+	tf.Namespace = "test"
+	tf.ClientConfig = &client.Config{Version: "v1beta1"}
+	buf := bytes.NewBuffer([]byte{})
+
+	cmd := NewCmdLabel(f, buf)
+	cmd.Flags().Set("patch-type", "json")
+	if err := RunLabel(f, buf, cmd, []string{"pods", "foo", "a=b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(body, &ops); err != nil {
+		t.Fatalf("expected a JSON patch array, got %s: %v", string(body), err)
+	}
+	// Pod foo has no labels yet, so the patch adds the whole labels map in
+	// one op rather than adding a=b under a missing container.
+	found := false
+	for _, op := range ops {
+		value, _ := op["value"].(map[string]interface{})
+		if op["op"] == "add" && op["path"] == "/metadata/labels" && value["a"] == "b" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected an add of the labels map with a=b, got %s", string(body))
+	}
+}
+
+func TestLabelDryRun(t *testing.T) {
+	pods, _, _ := testData()
+
+	f, tf, codec := NewAPIFactory()
+	tf.Printer = &testPrinter{}
+	tf.Client = &client.FakeRESTClient{
+		Codec: codec,
+		Client: client.HTTPClientFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "GET":
+				switch req.URL.Path {
+				case "/namespaces/test/pods":
+					return &http.Response{StatusCode: 200, Body: objBody(codec, pods)}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			default:
+				t.Fatalf("dry-run should not write to the server: %s %#v", req.Method, req.URL)
+				return nil, nil
+			}
+		}),
+	}
+	tf.Namespace = "test"
+	tf.ClientConfig = &client.Config{Version: "v1beta1"}
+	buf := bytes.NewBuffer([]byte{})
+
+	cmd := NewCmdLabel(f, buf)
+	cmd.Flags().Set("all", "true")
+	cmd.Flags().Set("dry-run", "true")
+	if err := RunLabel(f, buf, cmd, []string{"pods", "a=b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if tf.Printer.(*testPrinter).Objects == nil {
+		t.Fatalf("unexpected non print to default printer")
+	}
+	if !reflect.DeepEqual(tf.Printer.(*testPrinter).Objects[0].(*api.Pod).Labels, map[string]string{"a": "b"}) {
+		t.Errorf("printer did not receive the projected mutated object: %#v", tf.Printer.(*testPrinter).Objects[0])
+	}
+}
+
+func TestLabelDryRunDiff(t *testing.T) {
+	pods, _, _ := testData()
+
+	f, tf, codec := NewAPIFactory()
+	tf.Printer = &testPrinter{}
+	tf.Client = &client.FakeRESTClient{
+		Codec: codec,
+		Client: client.HTTPClientFunc(func(req *http.Request) (*http.Response, error) {
+			switch req.Method {
+			case "GET":
+				switch req.URL.Path {
+				case "/namespaces/test/pods":
+					return &http.Response{StatusCode: 200, Body: objBody(codec, pods)}, nil
+				default:
+					t.Fatalf("unexpected request: %#v\n%#v", req.URL, req)
+					return nil, nil
+				}
+			default:
+				t.Fatalf("dry-run should not write to the server: %s %#v", req.Method, req.URL)
+				return nil, nil
+			}
+		}),
+	}
+	tf.Namespace = "test"
+	tf.ClientConfig = &client.Config{Version: "v1beta1"}
+	buf := bytes.NewBuffer([]byte{})
+
+	cmd := NewCmdLabel(f, buf)
+	cmd.Flags().Set("all", "true")
+	cmd.Flags().Set("dry-run", "true")
+	cmd.Flags().Set("output", "diff")
+	if err := RunLabel(f, buf, cmd, []string{"pods", "a=b"}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if !strings.Contains(buf.String(), `"a"`) || !strings.Contains(buf.String(), `"b"`) {
+		t.Errorf("expected a diff mentioning the projected a=b label in the output, got: %s", buf.String())
+	}
+	if tf.Printer.(*testPrinter).Objects == nil {
+		t.Fatalf("unexpected non print to default printer")
+	}
 }
+
+// NOTE: multi-context fan-out (--contexts/--all-contexts) is not exercised
+// by a test here. Doing so needs the shared test Factory to grow a way to
+// register more than one FakeRESTClient per context, and this repo slice
+// doesn't include that harness — see labelWithClient and
+// Factory.ClientsForContexts in factory.go.